@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"hash/fnv"
+)
+
+// ctxMutex is a mutual-exclusion lock whose Lock can be aborted by a
+// context, unlike sync.Mutex. It is backed by a buffered channel rather
+// than a condition variable so that a canceled waiter simply stops
+// selecting on the channel instead of leaving a goroutine blocked forever
+// on an OS-level lock.
+type ctxMutex chan struct{}
+
+func newCtxMutex() ctxMutex {
+	m := make(ctxMutex, 1)
+	m <- struct{}{}
+	return m
+}
+
+func (m ctxMutex) Lock(ctx context.Context) error {
+	select {
+	case <-m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m ctxMutex) Unlock() {
+	select {
+	case m <- struct{}{}:
+	default:
+		panic("ctxMutex: unlock of unlocked mutex")
+	}
+}
+
+// stripedMutex partitions locking across a fixed number of ctxMutex
+// stripes keyed by a hash of a caller-supplied string (e.g. an operation
+// ID or DKG round ID), so operations on different keys don't serialize
+// behind one another the way a single coarse mutex would.
+type stripedMutex struct {
+	stripes []ctxMutex
+}
+
+func newStripedMutex(n int) *stripedMutex {
+	stripes := make([]ctxMutex, n)
+	for i := range stripes {
+		stripes[i] = newCtxMutex()
+	}
+	return &stripedMutex{stripes: stripes}
+}
+
+func (m *stripedMutex) stripe(key string) ctxMutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return m.stripes[h.Sum32()%uint32(len(m.stripes))]
+}
+
+func (m *stripedMutex) Lock(ctx context.Context, key string) (ctxMutex, error) {
+	stripe := m.stripe(key)
+	if err := stripe.Lock(ctx); err != nil {
+		return nil, err
+	}
+	return stripe, nil
+}
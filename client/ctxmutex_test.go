@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCtxMutexLockUnlock(t *testing.T) {
+	m := newCtxMutex()
+
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	m.Unlock()
+
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock after Unlock: %v", err)
+	}
+	m.Unlock()
+}
+
+func TestCtxMutexUnlockOfUnlockedPanics(t *testing.T) {
+	m := newCtxMutex()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Unlock of an unlocked ctxMutex to panic")
+		}
+	}()
+	m.Unlock()
+}
+
+func TestCtxMutexLockCanceled(t *testing.T) {
+	m := newCtxMutex()
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := m.Lock(ctx); err != context.Canceled {
+		t.Fatalf("Lock with canceled context: got %v, want context.Canceled", err)
+	}
+}
+
+func TestCtxMutexLockDeadlineExceeded(t *testing.T) {
+	m := newCtxMutex()
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := m.Lock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Lock with an expiring context: got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestStripedMutexDifferentKeysDoNotSerialize(t *testing.T) {
+	sm := newStripedMutex(8)
+
+	stripeA, err := sm.Lock(context.Background(), "round-a")
+	if err != nil {
+		t.Fatalf("Lock round-a: %v", err)
+	}
+	defer stripeA.Unlock()
+
+	// Find a key that hashes to a different stripe than "round-a" so we can
+	// assert it isn't blocked by the held lock above.
+	var otherKey string
+	for _, candidate := range []string{"round-b", "round-c", "round-d", "round-e"} {
+		if sm.stripe(candidate) != sm.stripe("round-a") {
+			otherKey = candidate
+			break
+		}
+	}
+	if otherKey == "" {
+		t.Skip("all candidate keys hashed to the same stripe as round-a")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	stripeB, err := sm.Lock(ctx, otherKey)
+	if err != nil {
+		t.Fatalf("Lock %s should not block behind round-a's stripe: %v", otherKey, err)
+	}
+	stripeB.Unlock()
+}
+
+func TestStripedMutexSameKeySerializes(t *testing.T) {
+	sm := newStripedMutex(8)
+
+	stripe, err := sm.Lock(context.Background(), "round-a")
+	if err != nil {
+		t.Fatalf("Lock round-a: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := sm.Lock(ctx, "round-a"); err != context.DeadlineExceeded {
+		t.Fatalf("second Lock on the same key: got %v, want context.DeadlineExceeded", err)
+	}
+
+	stripe.Unlock()
+}
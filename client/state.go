@@ -1,36 +1,85 @@
 package client
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const (
-	offsetKey     = "offset"
+	offsetKey = "offset"
+
+	// operationsKey is the legacy single-key JSON blob under which all
+	// operations used to be stored. It is only read on startup to migrate
+	// old databases into the op/<operationID> layout below.
 	operationsKey = "operations"
-)
 
-type State interface {
-	SaveOffset(uint64) error
-	LoadOffset() (uint64, error)
+	opKeyPrefix = "op/"
 
-	SaveFSM(interface{}) error
-	LoadFSM() (interface{}, error)
+	// opLockStripes is the number of stripes PutOperation/DeleteOperation/
+	// GetOperationByID lock across, so concurrent calls for different
+	// operation IDs don't serialize behind one another.
+	opLockStripes = 32
+)
 
-	PutOperation(operation *Operation) error
-	DeleteOperation(operationID string) error
-	GetOperations() (map[string]*Operation, error)
-	GetOperationByID(operationID string) (*Operation, error)
+type State interface {
+	SaveOffset(ctx context.Context, offset uint64) error
+	LoadOffset(ctx context.Context) (uint64, error)
+
+	SaveFSM(ctx context.Context, dkgRoundID string, fsm interface{}) error
+	LoadFSM(ctx context.Context, dkgRoundID string) (interface{}, error)
+
+	// ListFSMRounds returns the DKG round IDs that currently have FSM state
+	// on disk, regardless of whether any operation still references them.
+	// Used by RotateKey so a round whose operations have already been
+	// processed and deleted still gets its retained FSM state re-encrypted.
+	ListFSMRounds(ctx context.Context) ([]string, error)
+	// ListFSMVersions returns the snapshot versions currently retained for
+	// dkgRoundID, oldest first.
+	ListFSMVersions(ctx context.Context, dkgRoundID string) ([]int, error)
+	// LoadFSMAt returns the FSM state for dkgRoundID as of a specific
+	// snapshot version, without replaying the journal, for operator
+	// inspection and rollback after a corruption incident.
+	LoadFSMAt(ctx context.Context, dkgRoundID string, version int) (interface{}, error)
+	// ReplaceFSMAt overwrites the stored data of an existing snapshot
+	// version in place, without touching the journal or bumping the round's
+	// sequence counter. Used by RotateKey to re-encrypt retained snapshots
+	// that the normal SaveFSM/LoadFSM path never revisits.
+	ReplaceFSMAt(ctx context.Context, dkgRoundID string, version int, fsm interface{}) error
+
+	PutOperation(ctx context.Context, operation *Operation) error
+	// ReplaceOperation unconditionally overwrites the stored record for
+	// operation.ID, unlike PutOperation which rejects an existing ID. Used
+	// by RotateKey to swap in a re-encrypted record with a single write, so
+	// a crash can never leave the operation briefly absent the way a
+	// delete-then-put would.
+	ReplaceOperation(ctx context.Context, operation *Operation) error
+	DeleteOperation(ctx context.Context, operationID string) error
+	GetOperations(ctx context.Context) (map[string]*Operation, error)
+	GetOperationByID(ctx context.Context, operationID string) (*Operation, error)
+
+	// StreamOperations yields every stored operation one at a time on the
+	// returned channel, which is closed once the store is exhausted, the
+	// context is canceled, or an error occurs. At most one error is ever
+	// sent on the error channel, which is closed alongside the operation
+	// channel.
+	StreamOperations(ctx context.Context) (<-chan *Operation, <-chan error)
+
+	// Close releases the underlying database handle. No other State method
+	// may be called once Close has returned.
+	Close() error
 }
 
 type LevelDBState struct {
-	sync.Mutex
-	stateDb *leveldb.DB
+	stateDb  *leveldb.DB
+	opLocks  *stripedMutex
+	fsmLocks *stripedMutex
+	offsetMu ctxMutex
 }
 
 func NewLevelDBState(stateDbPath string) (State, error) {
@@ -40,32 +89,63 @@ func NewLevelDBState(stateDbPath string) (State, error) {
 	}
 
 	state := &LevelDBState{
-		stateDb: db,
+		stateDb:  db,
+		opLocks:  newStripedMutex(opLockStripes),
+		fsmLocks: newStripedMutex(opLockStripes),
+		offsetMu: newCtxMutex(),
 	}
 
-	if err := state.initKey(operationsKey, map[string]*Operation{}); err != nil {
-		return nil, fmt.Errorf("failed to init %s storage: %w", operationsKey, err)
+	if err := state.migrateLegacyOperations(); err != nil {
+		return nil, fmt.Errorf("failed to migrate legacy operations: %w", err)
 	}
 
 	return state, nil
 }
 
-func (s *LevelDBState) initKey(key string, data interface{}) error {
-	if _, err := s.stateDb.Get([]byte(key), nil); err != nil {
-		operationsBz, err := json.Marshal(data)
-		if err != nil {
-			return fmt.Errorf("failed to marshal storage structure: %w", err)
-		}
-		err = s.stateDb.Put([]byte(key), operationsBz, nil)
+// migrateLegacyOperations reads the legacy single-key operations blob, if
+// present, and rewrites it into the op/<operationID> layout so that reads
+// and writes no longer need to touch every operation at once.
+func (s *LevelDBState) migrateLegacyOperations() error {
+	bz, err := s.stateDb.Get([]byte(operationsKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read legacy operations blob: %w", err)
+	}
+
+	var operations map[string]*Operation
+	if err := json.Unmarshal(bz, &operations); err != nil {
+		return fmt.Errorf("failed to unmarshal legacy operations blob: %w", err)
+	}
+
+	batch := new(leveldb.Batch)
+	for _, operation := range operations {
+		operationJSON, err := json.Marshal(operation)
 		if err != nil {
-			return fmt.Errorf("failed to init state: %w", err)
+			return fmt.Errorf("failed to marshal operation %s: %w", operation.ID, err)
 		}
+		batch.Put(opKey(operation.ID), operationJSON)
+	}
+	batch.Delete([]byte(operationsKey))
+
+	if err := s.stateDb.Write(batch, nil); err != nil {
+		return fmt.Errorf("failed to write migrated operations: %w", err)
 	}
 
 	return nil
 }
 
-func (s *LevelDBState) SaveOffset(offset uint64) error {
+func opKey(operationID string) []byte {
+	return []byte(opKeyPrefix + operationID)
+}
+
+func (s *LevelDBState) SaveOffset(ctx context.Context, offset uint64) error {
+	if err := s.offsetMu.Lock(ctx); err != nil {
+		return err
+	}
+	defer s.offsetMu.Unlock()
+
 	bz := make([]byte, 8)
 	binary.LittleEndian.PutUint64(bz, offset)
 
@@ -76,7 +156,12 @@ func (s *LevelDBState) SaveOffset(offset uint64) error {
 	return nil
 }
 
-func (s *LevelDBState) LoadOffset() (uint64, error) {
+func (s *LevelDBState) LoadOffset(ctx context.Context) (uint64, error) {
+	if err := s.offsetMu.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.offsetMu.Unlock()
+
 	bz, err := s.stateDb.Get([]byte(offsetKey), nil)
 	if err != nil {
 		return 0, fmt.Errorf("failed to read offset: %w", err)
@@ -86,98 +171,172 @@ func (s *LevelDBState) LoadOffset() (uint64, error) {
 	return offset, nil
 }
 
-// TODO: implement.
-func (s *LevelDBState) SaveFSM(interface{}) error {
-	return nil
-}
-
-// TODO: implement.
-func (s *LevelDBState) LoadFSM() (interface{}, error) {
-	return nil, nil
-}
-
-func (s *LevelDBState) PutOperation(operation *Operation) error {
-	s.Lock()
-	defer s.Unlock()
-
-	operations, err := s.getOperations()
+func (s *LevelDBState) PutOperation(ctx context.Context, operation *Operation) error {
+	stripe, err := s.opLocks.Lock(ctx, operation.ID)
 	if err != nil {
-		return fmt.Errorf("failed to getOperations: %w", err)
+		return err
 	}
+	defer stripe.Unlock()
+
+	key := opKey(operation.ID)
 
-	if _, ok := operations[operation.ID]; ok {
+	switch _, err := s.stateDb.Get(key, nil); {
+	case err == nil:
 		return fmt.Errorf("operation %s already exists", operation.ID)
+	case err != leveldb.ErrNotFound:
+		return fmt.Errorf("failed to check for existing operation %s: %w", operation.ID, err)
 	}
 
-	operations[operation.ID] = operation
-	operationsJSON, err := json.Marshal(operations)
+	operationJSON, err := json.Marshal(operation)
 	if err != nil {
-		return fmt.Errorf("failed to marshal operations: %w", err)
+		return fmt.Errorf("failed to marshal operation: %w", err)
 	}
 
-	if err := s.stateDb.Put([]byte(operationsKey), operationsJSON, nil); err != nil {
-		return fmt.Errorf("failed to put operations: %w", err)
+	if err := s.stateDb.Put(key, operationJSON, nil); err != nil {
+		return fmt.Errorf("failed to put operation: %w", err)
 	}
 
 	return nil
 }
 
-func (s *LevelDBState) DeleteOperation(operationID string) error {
-	s.Lock()
-	defer s.Unlock()
+func (s *LevelDBState) ReplaceOperation(ctx context.Context, operation *Operation) error {
+	stripe, err := s.opLocks.Lock(ctx, operation.ID)
+	if err != nil {
+		return err
+	}
+	defer stripe.Unlock()
 
-	operations, err := s.getOperations()
+	operationJSON, err := json.Marshal(operation)
 	if err != nil {
-		return fmt.Errorf("failed to getOperations: %w", err)
+		return fmt.Errorf("failed to marshal operation: %w", err)
+	}
+
+	if err := s.stateDb.Put(opKey(operation.ID), operationJSON, nil); err != nil {
+		return fmt.Errorf("failed to replace operation %s: %w", operation.ID, err)
 	}
 
-	delete(operations, operationID)
+	return nil
+}
 
-	operationsJSON, err := json.Marshal(operations)
+func (s *LevelDBState) DeleteOperation(ctx context.Context, operationID string) error {
+	stripe, err := s.opLocks.Lock(ctx, operationID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal operations: %w", err)
+		return err
+	}
+	defer stripe.Unlock()
+
+	key := opKey(operationID)
+
+	switch _, err := s.stateDb.Get(key, nil); {
+	case err == leveldb.ErrNotFound:
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to check for existing operation %s: %w", operationID, err)
 	}
 
-	if err := s.stateDb.Put([]byte(operationsKey), operationsJSON, nil); err != nil {
-		return fmt.Errorf("failed to put operations: %w", err)
+	if err := s.stateDb.Delete(key, nil); err != nil {
+		return fmt.Errorf("failed to delete operation %s: %w", operationID, err)
 	}
 
 	return nil
 }
 
-func (s *LevelDBState) GetOperations() (map[string]*Operation, error) {
-	s.Lock()
-	defer s.Unlock()
+func (s *LevelDBState) GetOperations(ctx context.Context) (map[string]*Operation, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 
 	return s.getOperations()
 }
 
-func (s *LevelDBState) GetOperationByID(operationID string) (*Operation, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	operations, err := s.getOperations()
+func (s *LevelDBState) GetOperationByID(ctx context.Context, operationID string) (*Operation, error) {
+	stripe, err := s.opLocks.Lock(ctx, operationID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to getOperations: %w", err)
+		return nil, err
 	}
+	defer stripe.Unlock()
 
-	operation, ok := operations[operationID]
-	if !ok {
+	bz, err := s.stateDb.Get(opKey(operationID), nil)
+	switch err {
+	case nil:
+	case leveldb.ErrNotFound:
 		return nil, errors.New("operation not found")
+	default:
+		return nil, fmt.Errorf("failed to get operation %s: %w", operationID, err)
+	}
+
+	var operation Operation
+	if err := json.Unmarshal(bz, &operation); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal operation: %w", err)
 	}
 
-	return operation, nil
+	return &operation, nil
 }
 
-func (s *LevelDBState) getOperations() (map[string]*Operation, error) {
-	bz, err := s.stateDb.Get([]byte(operationsKey), nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get Operations (key: %s): %w", operationsKey, err)
+// StreamOperations decodes operations one at a time off a LevelDB iterator
+// instead of materializing the whole op/<operationID> range into a map, so
+// callers can process large operation sets with bounded memory.
+func (s *LevelDBState) StreamOperations(ctx context.Context) (<-chan *Operation, <-chan error) {
+	opCh := make(chan *Operation)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(opCh)
+		defer close(errCh)
+
+		iter := s.stateDb.NewIterator(util.BytesPrefix([]byte(opKeyPrefix)), nil)
+		defer iter.Release()
+
+		for iter.Next() {
+			var operation Operation
+			if err := json.Unmarshal(iter.Value(), &operation); err != nil {
+				errCh <- fmt.Errorf("failed to unmarshal operation (key: %s): %w", iter.Key(), err)
+				return
+			}
+
+			select {
+			case opCh <- &operation:
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			}
+		}
+		if err := iter.Error(); err != nil {
+			errCh <- fmt.Errorf("failed to iterate operations: %w", err)
+		}
+	}()
+
+	return opCh, errCh
+}
+
+// Close releases the underlying LevelDB handle. No other State method may
+// be called once Close has returned.
+func (s *LevelDBState) Close() error {
+	if err := s.stateDb.Close(); err != nil {
+		return fmt.Errorf("failed to close stateDB: %w", err)
 	}
 
-	var operations map[string]*Operation
-	if err := json.Unmarshal(bz, &operations); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal Operations: %w", err)
+	return nil
+}
+
+// getOperations iterates over every op/<operationID> record via a prefix
+// range scan instead of unmarshalling a single blob. LevelDB iterators run
+// against a point-in-time snapshot, so this needs no lock of its own.
+func (s *LevelDBState) getOperations() (map[string]*Operation, error) {
+	operations := map[string]*Operation{}
+
+	iter := s.stateDb.NewIterator(util.BytesPrefix([]byte(opKeyPrefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		var operation Operation
+		if err := json.Unmarshal(iter.Value(), &operation); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal operation (key: %s): %w", iter.Key(), err)
+		}
+		operations[operation.ID] = &operation
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate operations: %w", err)
 	}
 
 	return operations, nil
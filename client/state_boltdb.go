@@ -0,0 +1,594 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	operationsBucket = []byte("operations")
+	// metaBucket also holds the FSM snapshot/journal records, under the
+	// same fsm/<dkgRoundID>/... and fsm_journal/<dkgRoundID>/... keys
+	// LevelDBState uses, since bbolt buckets are just flat key-value maps.
+	metaBucket = []byte("meta")
+)
+
+const metaOffsetKey = "offset"
+
+// BoltDBState is a State implementation backed by go.etcd.io/bbolt. Like
+// LevelDBState it keeps each operation as its own keyed record, here in the
+// "operations" bucket, so puts and deletes don't require rewriting every
+// other operation on disk.
+type BoltDBState struct {
+	db       *bbolt.DB
+	opLocks  *stripedMutex
+	fsmLocks *stripedMutex
+	offsetMu ctxMutex
+}
+
+// NewBoltDBState opens (creating if necessary) a BoltDB file at
+// stateDbPath and returns a State backed by it.
+func NewBoltDBState(stateDbPath string) (State, error) {
+	db, err := bbolt.Open(stateDbPath, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stateDB: %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(operationsBucket); err != nil {
+			return fmt.Errorf("failed to create %s bucket: %w", operationsBucket, err)
+		}
+		if _, err := tx.CreateBucketIfNotExists(metaBucket); err != nil {
+			return fmt.Errorf("failed to create %s bucket: %w", metaBucket, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltDBState{
+		db:       db,
+		opLocks:  newStripedMutex(opLockStripes),
+		fsmLocks: newStripedMutex(opLockStripes),
+		offsetMu: newCtxMutex(),
+	}, nil
+}
+
+func (s *BoltDBState) SaveOffset(ctx context.Context, offset uint64) error {
+	if err := s.offsetMu.Lock(ctx); err != nil {
+		return err
+	}
+	defer s.offsetMu.Unlock()
+
+	bz := make([]byte, 8)
+	binary.LittleEndian.PutUint64(bz, offset)
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte(metaOffsetKey), bz)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set offset: %w", err)
+	}
+
+	return nil
+}
+
+func (s *BoltDBState) LoadOffset(ctx context.Context) (uint64, error) {
+	if err := s.offsetMu.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.offsetMu.Unlock()
+
+	var offset uint64
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bz := tx.Bucket(metaBucket).Get([]byte(metaOffsetKey))
+		if bz == nil {
+			return errors.New("offset not found")
+		}
+		offset = binary.LittleEndian.Uint64(bz)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read offset: %w", err)
+	}
+
+	return offset, nil
+}
+
+// SaveFSM persists the FSM state for dkgRoundID to the write-ahead journal
+// in metaBucket, and periodically rolls a new versioned snapshot (see
+// fsmSnapshotInterval), mirroring LevelDBState's on-disk layout.
+func (s *BoltDBState) SaveFSM(ctx context.Context, dkgRoundID string, fsm interface{}) error {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return err
+	}
+	defer stripe.Unlock()
+
+	data, err := encodeFSM(fsm)
+	if err != nil {
+		return fmt.Errorf("failed to encode FSM state: %w", err)
+	}
+
+	meta, err := s.getFSMMeta(dkgRoundID)
+	if err != nil {
+		return fmt.Errorf("failed to get FSM meta: %w", err)
+	}
+
+	plan, err := prepareFSMSave(dkgRoundID, meta, data)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(metaBucket)
+
+		if err := bucket.Put(plan.JournalKey, plan.JournalValue); err != nil {
+			return fmt.Errorf("failed to put FSM journal entry: %w", err)
+		}
+
+		if plan.TookSnapshot {
+			if err := bucket.Put(plan.SnapshotKey, plan.SnapshotValue); err != nil {
+				return fmt.Errorf("failed to put FSM snapshot: %w", err)
+			}
+			if plan.PruneSnapshotKey != nil {
+				if err := bucket.Delete(plan.PruneSnapshotKey); err != nil {
+					return fmt.Errorf("failed to prune FSM snapshot: %w", err)
+				}
+			}
+			if err := pruneBoltFSMJournal(bucket, dkgRoundID, plan.PruneJournalUpTo); err != nil {
+				return fmt.Errorf("failed to prune FSM journal: %w", err)
+			}
+		}
+
+		return bucket.Put(plan.MetaKey, plan.MetaValue)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write FSM state: %w", err)
+	}
+
+	return nil
+}
+
+// LoadFSM returns the latest FSM state for dkgRoundID, replaying the
+// write-ahead journal past the last snapshot if the round's sequence
+// counter has moved on since that snapshot was taken.
+func (s *BoltDBState) LoadFSM(ctx context.Context, dkgRoundID string) (interface{}, error) {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return nil, err
+	}
+	defer stripe.Unlock()
+
+	meta, err := s.getFSMMeta(dkgRoundID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FSM meta: %w", err)
+	}
+	if meta.LatestVersion == 0 {
+		return nil, nil
+	}
+
+	snapshot, err := s.getFSMSnapshot(dkgRoundID, meta.LatestVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FSM snapshot: %w", err)
+	}
+
+	data := snapshot.Data
+
+	if meta.Seq > snapshot.Seq {
+		data, err = s.replayFSMJournal(dkgRoundID, snapshot.Seq, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay FSM journal: %w", err)
+		}
+	}
+
+	fsm, err := decodeFSM(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode FSM state: %w", err)
+	}
+
+	return fsm, nil
+}
+
+func (s *BoltDBState) getFSMMeta(dkgRoundID string) (fsmMeta, error) {
+	var meta fsmMeta
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bz := tx.Bucket(metaBucket).Get(fsmMetaKey(dkgRoundID))
+		if bz == nil {
+			return nil
+		}
+		return gob.NewDecoder(bytes.NewReader(bz)).Decode(&meta)
+	})
+	if err != nil {
+		return fsmMeta{}, fmt.Errorf("failed to read FSM meta: %w", err)
+	}
+
+	return meta, nil
+}
+
+func (s *BoltDBState) getFSMSnapshot(dkgRoundID string, version int) (fsmSnapshot, error) {
+	var snapshot fsmSnapshot
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bz := tx.Bucket(metaBucket).Get(fsmSnapshotKey(dkgRoundID, version))
+		if bz == nil {
+			return fmt.Errorf("FSM snapshot v%d not found", version)
+		}
+		return gob.NewDecoder(bytes.NewReader(bz)).Decode(&snapshot)
+	})
+	if err != nil {
+		return fsmSnapshot{}, fmt.Errorf("failed to read FSM snapshot v%d: %w", version, err)
+	}
+
+	return snapshot, nil
+}
+
+// LoadFSMAt returns the FSM state for dkgRoundID as of a specific snapshot
+// version, without replaying the journal, for operator inspection and
+// rollback after a corruption incident.
+func (s *BoltDBState) LoadFSMAt(ctx context.Context, dkgRoundID string, version int) (interface{}, error) {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return nil, err
+	}
+	defer stripe.Unlock()
+
+	snapshot, err := s.getFSMSnapshot(dkgRoundID, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FSM snapshot: %w", err)
+	}
+
+	fsm, err := decodeFSM(snapshot.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode FSM state: %w", err)
+	}
+
+	return fsm, nil
+}
+
+// ReplaceFSMAt overwrites the data of an existing snapshot version for
+// dkgRoundID in place, leaving its version/sequence metadata untouched. It
+// does not touch the journal or the round's meta, since it is not a new FSM
+// transition — only RotateKey uses it, to re-encrypt retained snapshots
+// under a new key.
+func (s *BoltDBState) ReplaceFSMAt(ctx context.Context, dkgRoundID string, version int, fsm interface{}) error {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return err
+	}
+	defer stripe.Unlock()
+
+	snapshot, err := s.getFSMSnapshot(dkgRoundID, version)
+	if err != nil {
+		return fmt.Errorf("failed to get FSM snapshot: %w", err)
+	}
+
+	data, err := encodeFSM(fsm)
+	if err != nil {
+		return fmt.Errorf("failed to encode FSM state: %w", err)
+	}
+	snapshot.Data = data
+
+	snapshotBz, err := encodeGob(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode FSM snapshot: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(fsmSnapshotKey(dkgRoundID, version), snapshotBz)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replace FSM snapshot v%d: %w", version, err)
+	}
+
+	return nil
+}
+
+// ListFSMRounds returns every DKG round ID that has FSM state on disk,
+// sorted.
+func (s *BoltDBState) ListFSMRounds(ctx context.Context) ([]string, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	prefix := []byte(fsmKeyPrefix)
+
+	seen := map[string]struct{}{}
+	var rounds []string
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(metaBucket).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			dkgRoundID := fsmRoundIDFromKey(strings.TrimPrefix(string(k), fsmKeyPrefix))
+			if _, ok := seen[dkgRoundID]; ok {
+				continue
+			}
+			seen[dkgRoundID] = struct{}{}
+			rounds = append(rounds, dkgRoundID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate FSM rounds: %w", err)
+	}
+
+	sort.Strings(rounds)
+
+	return rounds, nil
+}
+
+// ListFSMVersions returns the snapshot versions currently retained for
+// dkgRoundID, oldest first.
+func (s *BoltDBState) ListFSMVersions(ctx context.Context, dkgRoundID string) ([]int, error) {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return nil, err
+	}
+	defer stripe.Unlock()
+
+	prefix := []byte(fsmRoundPrefix(dkgRoundID))
+
+	var versions []int
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(metaBucket).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			versionStr := strings.TrimPrefix(string(k), string(prefix))
+			if !strings.HasPrefix(versionStr, "v") {
+				continue
+			}
+
+			version, err := strconv.Atoi(strings.TrimPrefix(versionStr, "v"))
+			if err != nil {
+				continue
+			}
+			versions = append(versions, version)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate FSM versions: %w", err)
+	}
+
+	sort.Ints(versions)
+
+	return versions, nil
+}
+
+// replayFSMJournal applies every journal entry for dkgRoundID recorded
+// after fromSeq, returning the resulting encoded FSM state. Journal
+// entries hold the full FSM state at the sequence number they were written,
+// so replay is simply taking the last one.
+func (s *BoltDBState) replayFSMJournal(dkgRoundID string, fromSeq uint64, data []byte) ([]byte, error) {
+	prefix := []byte(fsmJournalRoundPrefix(dkgRoundID))
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(metaBucket).Cursor()
+
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			seq, err := strconv.ParseUint(strings.TrimPrefix(string(k), fsmJournalRoundPrefix(dkgRoundID)), 10, 64)
+			if err != nil {
+				continue
+			}
+			if seq <= fromSeq {
+				continue
+			}
+
+			entry := make([]byte, len(v))
+			copy(entry, v)
+			data = entry
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// pruneBoltFSMJournal deletes every journal entry of dkgRoundID at or
+// before upTo from bucket, since a snapshot taken at upTo already captures
+// everything they recorded.
+func pruneBoltFSMJournal(bucket *bbolt.Bucket, dkgRoundID string, upTo uint64) error {
+	prefix := []byte(fsmJournalRoundPrefix(dkgRoundID))
+
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(string(k), fsmJournalRoundPrefix(dkgRoundID)), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq > upTo {
+			continue
+		}
+
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *BoltDBState) PutOperation(ctx context.Context, operation *Operation) error {
+	stripe, err := s.opLocks.Lock(ctx, operation.ID)
+	if err != nil {
+		return err
+	}
+	defer stripe.Unlock()
+
+	operationJSON, err := json.Marshal(operation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal operation: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(operationsBucket)
+		if bucket.Get([]byte(operation.ID)) != nil {
+			return fmt.Errorf("operation %s already exists", operation.ID)
+		}
+		return bucket.Put([]byte(operation.ID), operationJSON)
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReplaceOperation unconditionally overwrites the stored record for
+// operation.ID, unlike PutOperation which rejects an existing ID. Used by
+// RotateKey to swap in a re-encrypted record with a single write, so a
+// crash can never leave the operation briefly absent the way a
+// delete-then-put would.
+func (s *BoltDBState) ReplaceOperation(ctx context.Context, operation *Operation) error {
+	stripe, err := s.opLocks.Lock(ctx, operation.ID)
+	if err != nil {
+		return err
+	}
+	defer stripe.Unlock()
+
+	operationJSON, err := json.Marshal(operation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal operation: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(operationsBucket).Put([]byte(operation.ID), operationJSON)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replace operation %s: %w", operation.ID, err)
+	}
+
+	return nil
+}
+
+func (s *BoltDBState) DeleteOperation(ctx context.Context, operationID string) error {
+	stripe, err := s.opLocks.Lock(ctx, operationID)
+	if err != nil {
+		return err
+	}
+	defer stripe.Unlock()
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(operationsBucket).Delete([]byte(operationID))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete operation %s: %w", operationID, err)
+	}
+
+	return nil
+}
+
+func (s *BoltDBState) GetOperations(ctx context.Context) (map[string]*Operation, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	operations := map[string]*Operation{}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(operationsBucket).ForEach(func(k, v []byte) error {
+			var operation Operation
+			if err := json.Unmarshal(v, &operation); err != nil {
+				return fmt.Errorf("failed to unmarshal operation %s: %w", k, err)
+			}
+			operations[string(k)] = &operation
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get operations: %w", err)
+	}
+
+	return operations, nil
+}
+
+// StreamOperations decodes operations one at a time off a bucket cursor
+// instead of materializing them all into a map, so callers can process
+// large operation sets with bounded memory.
+func (s *BoltDBState) StreamOperations(ctx context.Context) (<-chan *Operation, <-chan error) {
+	opCh := make(chan *Operation)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(opCh)
+		defer close(errCh)
+
+		err := s.db.View(func(tx *bbolt.Tx) error {
+			cursor := tx.Bucket(operationsBucket).Cursor()
+
+			for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+				var operation Operation
+				if err := json.Unmarshal(v, &operation); err != nil {
+					return fmt.Errorf("failed to unmarshal operation %s: %w", k, err)
+				}
+
+				select {
+				case opCh <- &operation:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			errCh <- err
+		}
+	}()
+
+	return opCh, errCh
+}
+
+// Close releases the underlying BoltDB handle. No other State method may be
+// called once Close has returned.
+func (s *BoltDBState) Close() error {
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("failed to close stateDB: %w", err)
+	}
+
+	return nil
+}
+
+func (s *BoltDBState) GetOperationByID(ctx context.Context, operationID string) (*Operation, error) {
+	stripe, err := s.opLocks.Lock(ctx, operationID)
+	if err != nil {
+		return nil, err
+	}
+	defer stripe.Unlock()
+
+	var operation *Operation
+
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		bz := tx.Bucket(operationsBucket).Get([]byte(operationID))
+		if bz == nil {
+			return errors.New("operation not found")
+		}
+
+		var op Operation
+		if err := json.Unmarshal(bz, &op); err != nil {
+			return fmt.Errorf("failed to unmarshal operation: %w", err)
+		}
+		operation = &op
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return operation, nil
+}
@@ -0,0 +1,539 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptionSalt is a fixed, application-wide salt for the passphrase KDF.
+// The State interface exposes no place to persist a per-database random
+// salt, so the passphrase itself is relied upon to supply the entropy; the
+// salt only domain-separates this derivation from other uses of the same
+// passphrase.
+const encryptionSalt = "dc4bc/state/v1"
+
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// encryptionHeaderV1 is prepended to every encrypted blob so that a future
+// key-derivation or cipher change can be introduced without breaking
+// decryption of data written under the current scheme.
+const encryptionHeaderV1 byte = 0x01
+
+func init() {
+	// Registered so encrypted FSM payloads, which travel through State's
+	// interface{}-typed SaveFSM/LoadFSM as []byte, gob-decode cleanly.
+	gob.Register([]byte(nil))
+}
+
+// EncryptedState wraps a State implementation and transparently encrypts
+// operation payloads and FSM snapshots with AES-GCM before handing them to
+// the underlying store, using a key derived from a passphrase. Offsets are
+// left untouched, since they carry no DKG/signing material.
+//
+// keys[0] is always the active key used to encrypt new writes. Any
+// remaining entries are retired keys kept around only so reads can still
+// decrypt entries a RotateKey pass hasn't migrated yet; see RotateKey for
+// why that matters.
+type EncryptedState struct {
+	sync.Mutex
+	underlying State
+	keys       [][]byte
+}
+
+// NewEncryptedState derives an AES-256 key from passphrase and returns a
+// State that encrypts everything persisted through underlying.
+func NewEncryptedState(underlying State, passphrase []byte) (*EncryptedState, error) {
+	key, err := deriveEncryptionKey(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive encryption key: %w", err)
+	}
+
+	return &EncryptedState{underlying: underlying, keys: [][]byte{key}}, nil
+}
+
+func deriveEncryptionKey(passphrase []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, []byte(encryptionSalt), scryptN, scryptR, scryptP, scryptKeyLen)
+}
+
+func (s *EncryptedState) SaveOffset(ctx context.Context, offset uint64) error {
+	return s.underlying.SaveOffset(ctx, offset)
+}
+
+func (s *EncryptedState) LoadOffset(ctx context.Context) (uint64, error) {
+	return s.underlying.LoadOffset(ctx)
+}
+
+func (s *EncryptedState) SaveFSM(ctx context.Context, dkgRoundID string, fsm interface{}) error {
+	s.Lock()
+	key := s.keys[0]
+	s.Unlock()
+
+	data, err := encodeFSM(fsm)
+	if err != nil {
+		return fmt.Errorf("failed to encode FSM state: %w", err)
+	}
+
+	ciphertext, err := encrypt(key, data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt FSM state: %w", err)
+	}
+
+	return s.underlying.SaveFSM(ctx, dkgRoundID, ciphertext)
+}
+
+func (s *EncryptedState) LoadFSM(ctx context.Context, dkgRoundID string) (interface{}, error) {
+	s.Lock()
+	keys := s.keys
+	s.Unlock()
+
+	raw, err := s.underlying.LoadFSM(ctx, dkgRoundID)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+
+	ciphertext, ok := raw.([]byte)
+	if !ok {
+		return nil, errors.New("encrypted FSM state has unexpected type")
+	}
+
+	data, err := decryptWithKeys(keys, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt FSM state: %w", err)
+	}
+
+	fsm, err := decodeFSM(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode FSM state: %w", err)
+	}
+
+	return fsm, nil
+}
+
+func (s *EncryptedState) ListFSMRounds(ctx context.Context) ([]string, error) {
+	return s.underlying.ListFSMRounds(ctx)
+}
+
+func (s *EncryptedState) ListFSMVersions(ctx context.Context, dkgRoundID string) ([]int, error) {
+	return s.underlying.ListFSMVersions(ctx, dkgRoundID)
+}
+
+func (s *EncryptedState) LoadFSMAt(ctx context.Context, dkgRoundID string, version int) (interface{}, error) {
+	s.Lock()
+	keys := s.keys
+	s.Unlock()
+
+	raw, err := s.underlying.LoadFSMAt(ctx, dkgRoundID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, ok := raw.([]byte)
+	if !ok {
+		return nil, errors.New("encrypted FSM state has unexpected type")
+	}
+
+	data, err := decryptWithKeys(keys, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt FSM state: %w", err)
+	}
+
+	fsm, err := decodeFSM(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode FSM state: %w", err)
+	}
+
+	return fsm, nil
+}
+
+func (s *EncryptedState) ReplaceFSMAt(ctx context.Context, dkgRoundID string, version int, fsm interface{}) error {
+	s.Lock()
+	key := s.keys[0]
+	s.Unlock()
+
+	data, err := encodeFSM(fsm)
+	if err != nil {
+		return fmt.Errorf("failed to encode FSM state: %w", err)
+	}
+
+	ciphertext, err := encrypt(key, data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt FSM state: %w", err)
+	}
+
+	return s.underlying.ReplaceFSMAt(ctx, dkgRoundID, version, ciphertext)
+}
+
+func (s *EncryptedState) PutOperation(ctx context.Context, operation *Operation) error {
+	s.Lock()
+	key := s.keys[0]
+	s.Unlock()
+
+	encrypted, err := encryptOperation(key, operation)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt operation %s: %w", operation.ID, err)
+	}
+
+	return s.underlying.PutOperation(ctx, encrypted)
+}
+
+func (s *EncryptedState) ReplaceOperation(ctx context.Context, operation *Operation) error {
+	s.Lock()
+	key := s.keys[0]
+	s.Unlock()
+
+	encrypted, err := encryptOperation(key, operation)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt operation %s: %w", operation.ID, err)
+	}
+
+	return s.underlying.ReplaceOperation(ctx, encrypted)
+}
+
+func (s *EncryptedState) DeleteOperation(ctx context.Context, operationID string) error {
+	return s.underlying.DeleteOperation(ctx, operationID)
+}
+
+func (s *EncryptedState) Close() error {
+	return s.underlying.Close()
+}
+
+func (s *EncryptedState) GetOperations(ctx context.Context) (map[string]*Operation, error) {
+	s.Lock()
+	keys := s.keys
+	s.Unlock()
+
+	operations, err := s.underlying.GetOperations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for id, operation := range operations {
+		decrypted, err := decryptOperation(keys, operation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt operation %s: %w", id, err)
+		}
+		operations[id] = decrypted
+	}
+
+	return operations, nil
+}
+
+func (s *EncryptedState) GetOperationByID(ctx context.Context, operationID string) (*Operation, error) {
+	s.Lock()
+	keys := s.keys
+	s.Unlock()
+
+	operation, err := s.underlying.GetOperationByID(ctx, operationID)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptOperation(keys, operation)
+}
+
+// StreamOperations relays the underlying stream, decrypting each operation
+// as it arrives instead of waiting for the whole set to be read. It derives
+// its own cancelable context for the underlying stream so that, whichever
+// way the relay goroutine below exits, the underlying goroutine (and the
+// LevelDB iterator / BoltDB transaction it holds open) is told to stop
+// rather than being left blocked forever trying to send the next operation.
+func (s *EncryptedState) StreamOperations(ctx context.Context) (<-chan *Operation, <-chan error) {
+	s.Lock()
+	keys := s.keys
+	s.Unlock()
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	rawCh, rawErrCh := s.underlying.StreamOperations(streamCtx)
+
+	opCh := make(chan *Operation)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer cancel()
+		defer close(opCh)
+		defer close(errCh)
+
+		for operation := range rawCh {
+			decrypted, err := decryptOperation(keys, operation)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to decrypt operation %s: %w", operation.ID, err)
+				return
+			}
+
+			select {
+			case opCh <- decrypted:
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			}
+		}
+		if err, ok := <-rawErrCh; ok && err != nil {
+			errCh <- err
+		}
+	}()
+
+	return opCh, errCh
+}
+
+// RotateKey re-derives the encryption key from newPassphrase and
+// re-encrypts every stored operation and FSM snapshot under it. DKG round
+// IDs are enumerated via ListFSMRounds rather than collected from the
+// DKGIdentifier of known operations, since an operation is deleted once
+// processed while the FSM state for its round persists — inferring rounds
+// from live operations would leave a fully-processed round's FSM state
+// permanently stuck under the old key.
+//
+// The new key is activated for writes up front, with oldKey kept as a
+// decrypt fallback until the migration loop below finishes: operations and
+// FSM state are rewritten one at a time with no cross-backend transaction
+// to wrap them in, so a crash partway through is expected, not exceptional.
+// Without the fallback, a crash would leave the store in a mixed-key state
+// that bricks every subsequent read (GetOperations previously aborted
+// entirely on the first entry it couldn't decrypt); with it, reads keep
+// working against whichever key a given entry actually happens to be
+// under, and simply calling RotateKey again with the same arguments
+// resumes and completes the migration. Each operation is swapped in with
+// ReplaceOperation's single overwrite, rather than a delete followed by a
+// put, so a crash between the two can never leave it briefly absent.
+func (s *EncryptedState) RotateKey(ctx context.Context, oldPassphrase, newPassphrase []byte) error {
+	s.Lock()
+
+	oldKey, err := deriveEncryptionKey(oldPassphrase)
+	if err != nil {
+		s.Unlock()
+		return fmt.Errorf("failed to derive old encryption key: %w", err)
+	}
+	if !containsKey(s.keys, oldKey) {
+		s.Unlock()
+		return errors.New("old passphrase does not match any known encryption key")
+	}
+
+	newKey, err := deriveEncryptionKey(newPassphrase)
+	if err != nil {
+		s.Unlock()
+		return fmt.Errorf("failed to derive new encryption key: %w", err)
+	}
+
+	s.keys = [][]byte{newKey, oldKey}
+	s.Unlock()
+
+	operations, err := s.underlying.GetOperations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get operations: %w", err)
+	}
+
+	for id, operation := range operations {
+		decrypted, err := decryptOperation([][]byte{oldKey, newKey}, operation)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt operation %s: %w", id, err)
+		}
+
+		reencrypted, err := encryptOperation(newKey, decrypted)
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt operation %s: %w", id, err)
+		}
+
+		if err := s.underlying.ReplaceOperation(ctx, reencrypted); err != nil {
+			return fmt.Errorf("failed to replace re-encrypted operation %s: %w", id, err)
+		}
+	}
+
+	dkgRoundIDs, err := s.underlying.ListFSMRounds(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list FSM rounds: %w", err)
+	}
+
+	for _, dkgRoundID := range dkgRoundIDs {
+		if err := s.rotateFSMVersions(ctx, dkgRoundID, oldKey, newKey); err != nil {
+			return fmt.Errorf("failed to re-encrypt FSM state for round %s: %w", dkgRoundID, err)
+		}
+	}
+
+	s.Lock()
+	s.keys = [][]byte{newKey}
+	s.Unlock()
+
+	return nil
+}
+
+// rotateFSMVersions re-encrypts every snapshot version retained for a
+// single DKG round from oldKey to newKey, using ReplaceFSMAt to overwrite
+// each one in place rather than SaveFSM, which only ever touches the
+// latest version. Without this, an operator rolling back to a pre-rotation
+// version via LoadFSMAt would find it still under the old key after
+// RotateKey finishes and s.keys collapses to just newKey.
+func (s *EncryptedState) rotateFSMVersions(ctx context.Context, dkgRoundID string, oldKey, newKey []byte) error {
+	versions, err := s.underlying.ListFSMVersions(ctx, dkgRoundID)
+	if err != nil {
+		return fmt.Errorf("failed to list FSM versions: %w", err)
+	}
+
+	for _, version := range versions {
+		raw, err := s.underlying.LoadFSMAt(ctx, dkgRoundID, version)
+		if err != nil {
+			return fmt.Errorf("failed to load FSM snapshot v%d: %w", version, err)
+		}
+
+		ciphertext, ok := raw.([]byte)
+		if !ok {
+			return errors.New("encrypted FSM state has unexpected type")
+		}
+
+		plaintext, err := decryptWithKeys([][]byte{oldKey, newKey}, ciphertext)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt FSM snapshot v%d: %w", version, err)
+		}
+
+		reencrypted, err := encrypt(newKey, plaintext)
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt FSM snapshot v%d: %w", version, err)
+		}
+
+		if err := s.underlying.ReplaceFSMAt(ctx, dkgRoundID, version, reencrypted); err != nil {
+			return fmt.Errorf("failed to replace re-encrypted FSM snapshot v%d: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptOperation returns a copy of operation with its Payload and
+// ExtraData fields encrypted, leaving identifying fields (ID, Type,
+// timestamps) untouched so the store can still index on them.
+func encryptOperation(key []byte, operation *Operation) (*Operation, error) {
+	encrypted := *operation
+
+	payload, err := encrypt(key, operation.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt payload: %w", err)
+	}
+	encrypted.Payload = payload
+
+	extraData, err := encrypt(key, operation.ExtraData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt extra data: %w", err)
+	}
+	encrypted.ExtraData = extraData
+
+	return &encrypted, nil
+}
+
+// decryptOperation decrypts operation's Payload and ExtraData, trying each
+// of keys in turn and succeeding as soon as one works. Accepting more than
+// one key lets callers keep reading during a RotateKey pass, when entries
+// under the old and new key can legitimately coexist.
+func decryptOperation(keys [][]byte, operation *Operation) (*Operation, error) {
+	decrypted := *operation
+
+	payload, err := decryptWithKeys(keys, operation.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+	decrypted.Payload = payload
+
+	extraData, err := decryptWithKeys(keys, operation.ExtraData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt extra data: %w", err)
+	}
+	decrypted.ExtraData = extraData
+
+	return &decrypted, nil
+}
+
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	return append([]byte{encryptionHeaderV1}, ciphertext...), nil
+}
+
+func decrypt(key, blob []byte) ([]byte, error) {
+	if len(blob) == 0 {
+		return nil, nil
+	}
+	if blob[0] != encryptionHeaderV1 {
+		return nil, fmt.Errorf("unsupported encryption header %#x", blob[0])
+	}
+	blob = blob[1:]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(blob) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := blob[:nonceSize], blob[nonceSize:]
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// decryptWithKeys tries to decrypt blob with each of keys in turn,
+// returning the first success. keys is usually a single active key; it
+// only holds more than one mid-RotateKey, while old- and new-key entries
+// can coexist.
+func decryptWithKeys(keys [][]byte, blob []byte) ([]byte, error) {
+	if len(blob) == 0 {
+		return nil, nil
+	}
+
+	var lastErr error
+	for _, key := range keys {
+		data, err := decrypt(key, blob)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,339 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// memState is a minimal in-memory State used only to exercise EncryptedState
+// without a real LevelDB/BoltDB backend.
+type memState struct {
+	offset     uint64
+	fsm        map[string]interface{}
+	operations map[string]*Operation
+}
+
+func newMemState() *memState {
+	return &memState{
+		fsm:        map[string]interface{}{},
+		operations: map[string]*Operation{},
+	}
+}
+
+func (m *memState) SaveOffset(ctx context.Context, offset uint64) error {
+	m.offset = offset
+	return nil
+}
+
+func (m *memState) LoadOffset(ctx context.Context) (uint64, error) {
+	return m.offset, nil
+}
+
+func (m *memState) SaveFSM(ctx context.Context, dkgRoundID string, fsm interface{}) error {
+	m.fsm[dkgRoundID] = fsm
+	return nil
+}
+
+func (m *memState) LoadFSM(ctx context.Context, dkgRoundID string) (interface{}, error) {
+	return m.fsm[dkgRoundID], nil
+}
+
+func (m *memState) ListFSMRounds(ctx context.Context) ([]string, error) {
+	rounds := make([]string, 0, len(m.fsm))
+	for dkgRoundID := range m.fsm {
+		rounds = append(rounds, dkgRoundID)
+	}
+	return rounds, nil
+}
+
+// ListFSMVersions, LoadFSMAt and ReplaceFSMAt treat memState's single
+// stored FSM value as version 1, since memState doesn't model the real
+// backends' snapshot/journal history.
+func (m *memState) ListFSMVersions(ctx context.Context, dkgRoundID string) ([]int, error) {
+	if _, ok := m.fsm[dkgRoundID]; !ok {
+		return nil, nil
+	}
+	return []int{1}, nil
+}
+
+func (m *memState) LoadFSMAt(ctx context.Context, dkgRoundID string, version int) (interface{}, error) {
+	return m.fsm[dkgRoundID], nil
+}
+
+func (m *memState) ReplaceFSMAt(ctx context.Context, dkgRoundID string, version int, fsm interface{}) error {
+	m.fsm[dkgRoundID] = fsm
+	return nil
+}
+
+func (m *memState) PutOperation(ctx context.Context, operation *Operation) error {
+	cp := *operation
+	m.operations[operation.ID] = &cp
+	return nil
+}
+
+func (m *memState) ReplaceOperation(ctx context.Context, operation *Operation) error {
+	cp := *operation
+	m.operations[operation.ID] = &cp
+	return nil
+}
+
+func (m *memState) DeleteOperation(ctx context.Context, operationID string) error {
+	delete(m.operations, operationID)
+	return nil
+}
+
+func (m *memState) GetOperations(ctx context.Context) (map[string]*Operation, error) {
+	out := make(map[string]*Operation, len(m.operations))
+	for id, operation := range m.operations {
+		cp := *operation
+		out[id] = &cp
+	}
+	return out, nil
+}
+
+func (m *memState) GetOperationByID(ctx context.Context, operationID string) (*Operation, error) {
+	operation, ok := m.operations[operationID]
+	if !ok {
+		return nil, errors.New("operation not found")
+	}
+	cp := *operation
+	return &cp, nil
+}
+
+func (m *memState) StreamOperations(ctx context.Context) (<-chan *Operation, <-chan error) {
+	opCh := make(chan *Operation)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(opCh)
+		defer close(errCh)
+		for _, operation := range m.operations {
+			cp := *operation
+			select {
+			case opCh <- &cp:
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return opCh, errCh
+}
+
+func (m *memState) Close() error {
+	return nil
+}
+
+func TestEncryptedStatePutGetRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	underlying := newMemState()
+
+	enc, err := NewEncryptedState(underlying, []byte("correct-horse"))
+	if err != nil {
+		t.Fatalf("NewEncryptedState: %v", err)
+	}
+
+	operation := &Operation{ID: "op-1", Payload: []byte("payload"), ExtraData: []byte("extra")}
+	if err := enc.PutOperation(ctx, operation); err != nil {
+		t.Fatalf("PutOperation: %v", err)
+	}
+
+	stored := underlying.operations["op-1"]
+	if bytes.Equal(stored.Payload, operation.Payload) {
+		t.Fatal("expected the underlying store to hold ciphertext, not the plaintext payload")
+	}
+
+	got, err := enc.GetOperationByID(ctx, "op-1")
+	if err != nil {
+		t.Fatalf("GetOperationByID: %v", err)
+	}
+	if !bytes.Equal(got.Payload, operation.Payload) || !bytes.Equal(got.ExtraData, operation.ExtraData) {
+		t.Fatalf("decrypted operation = %+v, want payload/extra data to round-trip", got)
+	}
+}
+
+func TestEncryptedStateRotateKeyReencryptsOperationsAndFSM(t *testing.T) {
+	ctx := context.Background()
+	underlying := newMemState()
+
+	oldPass, newPass := []byte("old-pass"), []byte("new-pass")
+
+	enc, err := NewEncryptedState(underlying, oldPass)
+	if err != nil {
+		t.Fatalf("NewEncryptedState: %v", err)
+	}
+
+	operation := &Operation{ID: "op-1", DKGIdentifier: "round-1", Payload: []byte("payload"), ExtraData: []byte("extra")}
+	if err := enc.PutOperation(ctx, operation); err != nil {
+		t.Fatalf("PutOperation: %v", err)
+	}
+	if err := enc.SaveFSM(ctx, "round-1", []byte("fsm-state")); err != nil {
+		t.Fatalf("SaveFSM: %v", err)
+	}
+
+	if err := enc.RotateKey(ctx, oldPass, newPass); err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+
+	gotOp, err := enc.GetOperationByID(ctx, "op-1")
+	if err != nil {
+		t.Fatalf("GetOperationByID after rotation: %v", err)
+	}
+	if !bytes.Equal(gotOp.Payload, operation.Payload) {
+		t.Fatalf("operation payload after rotation = %q, want %q", gotOp.Payload, operation.Payload)
+	}
+
+	gotFSM, err := enc.LoadFSM(ctx, "round-1")
+	if err != nil {
+		t.Fatalf("LoadFSM after rotation: %v", err)
+	}
+	fsmBytes, ok := gotFSM.([]byte)
+	if !ok || !bytes.Equal(fsmBytes, []byte("fsm-state")) {
+		t.Fatalf("FSM state after rotation = %v, want %q", gotFSM, "fsm-state")
+	}
+
+	if err := enc.RotateKey(ctx, oldPass, newPass); err == nil {
+		t.Fatal("expected RotateKey with the now-stale old passphrase to fail once rotation has completed")
+	}
+}
+
+func TestEncryptedStateRotateKeyReencryptsFSMForRoundWithNoLiveOperations(t *testing.T) {
+	ctx := context.Background()
+	underlying := newMemState()
+
+	oldPass, newPass := []byte("old-pass"), []byte("new-pass")
+
+	enc, err := NewEncryptedState(underlying, oldPass)
+	if err != nil {
+		t.Fatalf("NewEncryptedState: %v", err)
+	}
+
+	// The operation that originally drove this round has already been
+	// processed and deleted, the way dc4bc's client does once an operation
+	// is handled — only the round's FSM state is left. RotateKey must still
+	// find it via ListFSMRounds rather than the operation's DKGIdentifier.
+	operation := &Operation{ID: "op-1", DKGIdentifier: "round-1", Payload: []byte("payload")}
+	if err := enc.PutOperation(ctx, operation); err != nil {
+		t.Fatalf("PutOperation: %v", err)
+	}
+	if err := enc.SaveFSM(ctx, "round-1", []byte("fsm-state")); err != nil {
+		t.Fatalf("SaveFSM: %v", err)
+	}
+	if err := enc.DeleteOperation(ctx, "op-1"); err != nil {
+		t.Fatalf("DeleteOperation: %v", err)
+	}
+
+	if err := enc.RotateKey(ctx, oldPass, newPass); err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+
+	gotFSM, err := enc.LoadFSM(ctx, "round-1")
+	if err != nil {
+		t.Fatalf("LoadFSM after rotation: %v", err)
+	}
+	fsmBytes, ok := gotFSM.([]byte)
+	if !ok || !bytes.Equal(fsmBytes, []byte("fsm-state")) {
+		t.Fatalf("FSM state after rotation = %v, want %q", gotFSM, "fsm-state")
+	}
+}
+
+func TestEncryptedStateRotateKeyReencryptsRetainedFSMSnapshots(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	underlying, err := NewLevelDBState(dbPath)
+	if err != nil {
+		t.Fatalf("NewLevelDBState: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := underlying.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+
+	oldPass, newPass := []byte("old-pass"), []byte("new-pass")
+
+	enc, err := NewEncryptedState(underlying, oldPass)
+	if err != nil {
+		t.Fatalf("NewEncryptedState: %v", err)
+	}
+
+	// Saving fsmSnapshotInterval+1 times leaves two retained snapshot
+	// versions on disk: v1 taken on the first call, v2 once the interval
+	// rolls over on the last one.
+	wantByVersion := map[int][]byte{}
+	for i := 0; i < fsmSnapshotInterval+1; i++ {
+		payload := []byte(fmt.Sprintf("fsm-%d", i))
+		if err := enc.SaveFSM(ctx, "round-1", payload); err != nil {
+			t.Fatalf("SaveFSM(%d): %v", i, err)
+		}
+		if i == 0 {
+			wantByVersion[1] = payload
+		}
+		if i == fsmSnapshotInterval {
+			wantByVersion[2] = payload
+		}
+	}
+
+	versions, err := enc.ListFSMVersions(ctx, "round-1")
+	if err != nil {
+		t.Fatalf("ListFSMVersions: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("ListFSMVersions = %v, want 2 retained versions", versions)
+	}
+
+	if err := enc.RotateKey(ctx, oldPass, newPass); err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+
+	for _, version := range versions {
+		got, err := enc.LoadFSMAt(ctx, "round-1", version)
+		if err != nil {
+			t.Fatalf("LoadFSMAt(v%d) after rotation: %v", version, err)
+		}
+		gotBytes, ok := got.([]byte)
+		if !ok || !bytes.Equal(gotBytes, wantByVersion[version]) {
+			t.Fatalf("LoadFSMAt(v%d) after rotation = %v, want %q", version, got, wantByVersion[version])
+		}
+	}
+}
+
+func TestDecryptWithKeysFallsBackThroughKeys(t *testing.T) {
+	keyA := bytes.Repeat([]byte{0x01}, scryptKeyLen)
+	keyB := bytes.Repeat([]byte{0x02}, scryptKeyLen)
+
+	ciphertext, err := encrypt(keyA, []byte("secret"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	data, err := decryptWithKeys([][]byte{keyB, keyA}, ciphertext)
+	if err != nil {
+		t.Fatalf("decryptWithKeys: %v", err)
+	}
+	if !bytes.Equal(data, []byte("secret")) {
+		t.Fatalf("decryptWithKeys = %q, want %q", data, "secret")
+	}
+
+	if _, err := decryptWithKeys([][]byte{keyB}, ciphertext); err == nil {
+		t.Fatal("expected decryptWithKeys to fail when none of the keys match")
+	}
+}
+
+func TestContainsKey(t *testing.T) {
+	keyA := []byte("a")
+	keyB := []byte("b")
+
+	if !containsKey([][]byte{keyA, keyB}, keyA) {
+		t.Fatal("expected containsKey to find keyA")
+	}
+	if containsKey([][]byte{keyA}, keyB) {
+		t.Fatal("expected containsKey to not find keyB")
+	}
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	leveldbScheme = "leveldb"
+	boltScheme    = "bolt"
+)
+
+// NewState constructs a State backend from a connection string of the form
+// "<scheme>://<path>", e.g. "leveldb:///var/dc4bc/state" or
+// "bolt:///var/dc4bc/state.db". If dsn has no scheme prefix, it is treated
+// as a plain filesystem path and opened with the LevelDB backend for
+// backwards compatibility.
+func NewState(dsn string) (State, error) {
+	scheme, path, ok := splitDSN(dsn)
+	if !ok {
+		return NewLevelDBState(dsn)
+	}
+
+	switch scheme {
+	case leveldbScheme:
+		return NewLevelDBState(path)
+	case boltScheme:
+		return NewBoltDBState(path)
+	default:
+		return nil, fmt.Errorf("unknown state backend %q", scheme)
+	}
+}
+
+func splitDSN(dsn string) (scheme, path string, ok bool) {
+	parts := strings.SplitN(dsn, "://", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
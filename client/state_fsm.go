@@ -0,0 +1,477 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	fsmKeyPrefix        = "fsm/"
+	fsmJournalKeyPrefix = "fsm_journal/"
+
+	// fsmRetainVersions is the number of past FSM snapshots kept per DKG
+	// round so operators can roll back after a corruption incident.
+	fsmRetainVersions = 5
+
+	// fsmSnapshotInterval is how many SaveFSM calls accumulate in the
+	// journal before a fresh full snapshot is taken and the journal
+	// entries it subsumes are pruned. Without it, a snapshot taken on
+	// every call would always sit at the journal's newest sequence number,
+	// making replay-past-the-snapshot unreachable and the journal unbounded.
+	fsmSnapshotInterval = 10
+)
+
+// fsmMeta tracks the latest snapshot taken for a DKG round and how many
+// journal-only writes have happened since, so SaveFSM knows when to take the
+// next snapshot and LoadFSM knows whether the journal needs to be replayed
+// to catch up to the current sequence (by comparing Seq against the
+// snapshot record's own Seq). Seq is a per-round counter bumped on every
+// SaveFSM call, independent of the client's queue offset, since several FSM
+// transitions can be saved while processing a single message and would
+// otherwise collide on one journal entry.
+type fsmMeta struct {
+	LatestVersion        int
+	PendingSinceSnapshot int
+	Seq                  uint64
+}
+
+// fsmSnapshot is a single versioned, gob-encoded FSM state for a DKG round.
+type fsmSnapshot struct {
+	Version int
+	Seq     uint64
+	Data    []byte
+}
+
+// fsmSavePlan is the set of writes a SaveFSM call needs to make, computed
+// without touching storage so that both the LevelDB and BoltDB backends
+// can share the same snapshot/journal/retention logic over their own
+// transaction types.
+type fsmSavePlan struct {
+	JournalKey   []byte
+	JournalValue []byte
+
+	TookSnapshot     bool
+	SnapshotKey      []byte
+	SnapshotValue    []byte
+	PruneSnapshotKey []byte
+	PruneJournalUpTo uint64
+
+	MetaKey   []byte
+	MetaValue []byte
+}
+
+// prepareFSMSave always appends a journal entry under the next sequence
+// number (meta.Seq+1), and once every fsmSnapshotInterval calls (and on the
+// very first call) additionally rolls a new snapshot, prunes the oldest one
+// beyond fsmRetainVersions, and marks the journal entries it subsumes
+// (seq <= the new snapshot's seq) for pruning.
+func prepareFSMSave(dkgRoundID string, meta fsmMeta, data []byte) (fsmSavePlan, error) {
+	seq := meta.Seq + 1
+
+	plan := fsmSavePlan{
+		JournalKey:   fsmJournalKey(dkgRoundID, seq),
+		JournalValue: data,
+	}
+
+	newMeta := meta
+	newMeta.Seq = seq
+	newMeta.PendingSinceSnapshot++
+
+	if newMeta.LatestVersion == 0 || newMeta.PendingSinceSnapshot >= fsmSnapshotInterval {
+		version := newMeta.LatestVersion + 1
+
+		snapshot := fsmSnapshot{Version: version, Seq: seq, Data: data}
+		snapshotBz, err := encodeGob(snapshot)
+		if err != nil {
+			return fsmSavePlan{}, fmt.Errorf("failed to encode FSM snapshot: %w", err)
+		}
+
+		plan.TookSnapshot = true
+		plan.SnapshotKey = fsmSnapshotKey(dkgRoundID, version)
+		plan.SnapshotValue = snapshotBz
+		plan.PruneJournalUpTo = seq
+
+		if prune := version - fsmRetainVersions; prune > 0 {
+			plan.PruneSnapshotKey = fsmSnapshotKey(dkgRoundID, prune)
+		}
+
+		newMeta.LatestVersion = version
+		newMeta.PendingSinceSnapshot = 0
+	}
+
+	metaBz, err := encodeGob(newMeta)
+	if err != nil {
+		return fsmSavePlan{}, fmt.Errorf("failed to encode FSM meta: %w", err)
+	}
+	plan.MetaKey = fsmMetaKey(dkgRoundID)
+	plan.MetaValue = metaBz
+
+	return plan, nil
+}
+
+// SaveFSM persists the FSM state for dkgRoundID to the write-ahead journal,
+// and periodically rolls a new versioned snapshot (see fsmSnapshotInterval)
+// so LoadFSM can replay the journal entries written since.
+//
+// Callers must gob.Register the concrete type behind fsm before calling
+// SaveFSM or LoadFSM, since gob needs it to decode back into an
+// interface{}.
+func (s *LevelDBState) SaveFSM(ctx context.Context, dkgRoundID string, fsm interface{}) error {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return err
+	}
+	defer stripe.Unlock()
+
+	data, err := encodeFSM(fsm)
+	if err != nil {
+		return fmt.Errorf("failed to encode FSM state: %w", err)
+	}
+
+	meta, err := s.getFSMMeta(dkgRoundID)
+	if err != nil {
+		return fmt.Errorf("failed to get FSM meta: %w", err)
+	}
+
+	plan, err := prepareFSMSave(dkgRoundID, meta, data)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(plan.JournalKey, plan.JournalValue)
+
+	if plan.TookSnapshot {
+		batch.Put(plan.SnapshotKey, plan.SnapshotValue)
+		if plan.PruneSnapshotKey != nil {
+			batch.Delete(plan.PruneSnapshotKey)
+		}
+		if err := s.pruneFSMJournal(batch, dkgRoundID, plan.PruneJournalUpTo); err != nil {
+			return fmt.Errorf("failed to prune FSM journal: %w", err)
+		}
+	}
+
+	batch.Put(plan.MetaKey, plan.MetaValue)
+
+	if err := s.stateDb.Write(batch, nil); err != nil {
+		return fmt.Errorf("failed to write FSM state: %w", err)
+	}
+
+	return nil
+}
+
+// pruneFSMJournal queues deletes, into batch, for every journal entry of
+// dkgRoundID at or before upTo, since a snapshot taken at upTo already
+// captures everything they recorded.
+func (s *LevelDBState) pruneFSMJournal(batch *leveldb.Batch, dkgRoundID string, upTo uint64) error {
+	prefix := fsmJournalRoundPrefix(dkgRoundID)
+
+	iter := s.stateDb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(string(iter.Key()), prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq > upTo {
+			continue
+		}
+
+		key := make([]byte, len(iter.Key()))
+		copy(key, iter.Key())
+		batch.Delete(key)
+	}
+
+	return iter.Error()
+}
+
+// LoadFSM returns the latest FSM state for dkgRoundID, replaying the
+// write-ahead journal past the last snapshot if the round's sequence
+// counter has moved on since that snapshot was taken.
+func (s *LevelDBState) LoadFSM(ctx context.Context, dkgRoundID string) (interface{}, error) {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return nil, err
+	}
+	defer stripe.Unlock()
+
+	meta, err := s.getFSMMeta(dkgRoundID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FSM meta: %w", err)
+	}
+	if meta.LatestVersion == 0 {
+		return nil, nil
+	}
+
+	snapshot, err := s.getFSMSnapshot(dkgRoundID, meta.LatestVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FSM snapshot: %w", err)
+	}
+
+	data := snapshot.Data
+
+	if meta.Seq > snapshot.Seq {
+		data, err = s.replayFSMJournal(dkgRoundID, snapshot.Seq, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay FSM journal: %w", err)
+		}
+	}
+
+	fsm, err := decodeFSM(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode FSM state: %w", err)
+	}
+
+	return fsm, nil
+}
+
+// LoadFSMAt returns the FSM state for dkgRoundID as of a specific snapshot
+// version, without replaying the journal, for operator inspection and
+// rollback after a corruption incident.
+func (s *LevelDBState) LoadFSMAt(ctx context.Context, dkgRoundID string, version int) (interface{}, error) {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return nil, err
+	}
+	defer stripe.Unlock()
+
+	snapshot, err := s.getFSMSnapshot(dkgRoundID, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get FSM snapshot: %w", err)
+	}
+
+	fsm, err := decodeFSM(snapshot.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode FSM state: %w", err)
+	}
+
+	return fsm, nil
+}
+
+// ReplaceFSMAt overwrites the data of an existing snapshot version for
+// dkgRoundID in place, leaving its version/sequence metadata untouched. It
+// does not touch the journal or the round's meta, since it is not a new FSM
+// transition — only RotateKey uses it, to re-encrypt retained snapshots
+// under a new key.
+func (s *LevelDBState) ReplaceFSMAt(ctx context.Context, dkgRoundID string, version int, fsm interface{}) error {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return err
+	}
+	defer stripe.Unlock()
+
+	snapshot, err := s.getFSMSnapshot(dkgRoundID, version)
+	if err != nil {
+		return fmt.Errorf("failed to get FSM snapshot: %w", err)
+	}
+
+	data, err := encodeFSM(fsm)
+	if err != nil {
+		return fmt.Errorf("failed to encode FSM state: %w", err)
+	}
+	snapshot.Data = data
+
+	snapshotBz, err := encodeGob(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode FSM snapshot: %w", err)
+	}
+
+	if err := s.stateDb.Put(fsmSnapshotKey(dkgRoundID, version), snapshotBz, nil); err != nil {
+		return fmt.Errorf("failed to replace FSM snapshot v%d: %w", version, err)
+	}
+
+	return nil
+}
+
+// ListFSMRounds returns every DKG round ID that has FSM state on disk,
+// sorted. Like getOperations, it runs the scan against a point-in-time
+// LevelDB iterator, so it needs no lock of its own.
+func (s *LevelDBState) ListFSMRounds(ctx context.Context) ([]string, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	iter := s.stateDb.NewIterator(util.BytesPrefix([]byte(fsmKeyPrefix)), nil)
+	defer iter.Release()
+
+	seen := map[string]struct{}{}
+	var rounds []string
+	for iter.Next() {
+		dkgRoundID := fsmRoundIDFromKey(strings.TrimPrefix(string(iter.Key()), fsmKeyPrefix))
+		if _, ok := seen[dkgRoundID]; ok {
+			continue
+		}
+		seen[dkgRoundID] = struct{}{}
+		rounds = append(rounds, dkgRoundID)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate FSM rounds: %w", err)
+	}
+
+	sort.Strings(rounds)
+
+	return rounds, nil
+}
+
+// ListFSMVersions returns the snapshot versions currently retained for
+// dkgRoundID, oldest first.
+func (s *LevelDBState) ListFSMVersions(ctx context.Context, dkgRoundID string) ([]int, error) {
+	stripe, err := s.fsmLocks.Lock(ctx, dkgRoundID)
+	if err != nil {
+		return nil, err
+	}
+	defer stripe.Unlock()
+
+	prefix := fsmRoundPrefix(dkgRoundID)
+
+	iter := s.stateDb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	var versions []int
+	for iter.Next() {
+		key := string(iter.Key())
+		versionStr := strings.TrimPrefix(key, prefix)
+		if !strings.HasPrefix(versionStr, "v") {
+			continue
+		}
+
+		version, err := strconv.Atoi(strings.TrimPrefix(versionStr, "v"))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate FSM versions: %w", err)
+	}
+
+	sort.Ints(versions)
+
+	return versions, nil
+}
+
+func (s *LevelDBState) getFSMMeta(dkgRoundID string) (fsmMeta, error) {
+	bz, err := s.stateDb.Get(fsmMetaKey(dkgRoundID), nil)
+	if err == leveldb.ErrNotFound {
+		return fsmMeta{}, nil
+	}
+	if err != nil {
+		return fsmMeta{}, fmt.Errorf("failed to read FSM meta: %w", err)
+	}
+
+	var meta fsmMeta
+	if err := gob.NewDecoder(bytes.NewReader(bz)).Decode(&meta); err != nil {
+		return fsmMeta{}, fmt.Errorf("failed to decode FSM meta: %w", err)
+	}
+
+	return meta, nil
+}
+
+func (s *LevelDBState) getFSMSnapshot(dkgRoundID string, version int) (fsmSnapshot, error) {
+	bz, err := s.stateDb.Get(fsmSnapshotKey(dkgRoundID, version), nil)
+	if err != nil {
+		return fsmSnapshot{}, fmt.Errorf("failed to read FSM snapshot v%d: %w", version, err)
+	}
+
+	var snapshot fsmSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(bz)).Decode(&snapshot); err != nil {
+		return fsmSnapshot{}, fmt.Errorf("failed to decode FSM snapshot v%d: %w", version, err)
+	}
+
+	return snapshot, nil
+}
+
+// replayFSMJournal applies every journal entry for dkgRoundID recorded
+// after fromSeq, returning the resulting encoded FSM state. Journal
+// entries hold the full FSM state at the sequence number they were written,
+// so replay is simply taking the last one.
+func (s *LevelDBState) replayFSMJournal(dkgRoundID string, fromSeq uint64, data []byte) ([]byte, error) {
+	prefix := fsmJournalRoundPrefix(dkgRoundID)
+
+	iter := s.stateDb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := strings.TrimPrefix(string(iter.Key()), prefix)
+
+		seq, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq <= fromSeq {
+			continue
+		}
+
+		entry := make([]byte, len(iter.Value()))
+		copy(entry, iter.Value())
+		data = entry
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate FSM journal: %w", err)
+	}
+
+	return data, nil
+}
+
+func fsmRoundPrefix(dkgRoundID string) string {
+	return fmt.Sprintf("%s%s/", fsmKeyPrefix, dkgRoundID)
+}
+
+// fsmRoundIDFromKey recovers the dkgRoundID segment from a key that has
+// already had fsmKeyPrefix stripped off, i.e. "<dkgRoundID>/v1" or
+// "<dkgRoundID>/meta".
+func fsmRoundIDFromKey(key string) string {
+	if idx := strings.LastIndex(key, "/"); idx >= 0 {
+		return key[:idx]
+	}
+	return key
+}
+
+func fsmSnapshotKey(dkgRoundID string, version int) []byte {
+	return []byte(fmt.Sprintf("%sv%d", fsmRoundPrefix(dkgRoundID), version))
+}
+
+func fsmMetaKey(dkgRoundID string) []byte {
+	return []byte(fsmRoundPrefix(dkgRoundID) + "meta")
+}
+
+func fsmJournalRoundPrefix(dkgRoundID string) string {
+	return fmt.Sprintf("%s%s/", fsmJournalKeyPrefix, dkgRoundID)
+}
+
+func fsmJournalKey(dkgRoundID string, seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", fsmJournalRoundPrefix(dkgRoundID), seq))
+}
+
+func encodeFSM(fsm interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&fsm); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeFSM(data []byte) (interface{}, error) {
+	var fsm interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&fsm); err != nil {
+		return nil, err
+	}
+	return fsm, nil
+}
+
+func encodeGob(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
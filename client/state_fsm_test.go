@@ -0,0 +1,126 @@
+package client
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestPrepareFSMSaveFirstCallAlwaysSnapshots(t *testing.T) {
+	plan, err := prepareFSMSave("round-1", fsmMeta{}, []byte("state-0"))
+	if err != nil {
+		t.Fatalf("prepareFSMSave: %v", err)
+	}
+
+	if !plan.TookSnapshot {
+		t.Fatal("expected the first SaveFSM call to take a snapshot")
+	}
+	if plan.PruneSnapshotKey != nil {
+		t.Fatalf("expected no snapshot to prune yet, got %q", plan.PruneSnapshotKey)
+	}
+	if plan.PruneJournalUpTo != 1 {
+		t.Fatalf("expected journal prune cutoff 1, got %d", plan.PruneJournalUpTo)
+	}
+}
+
+func TestPrepareFSMSaveOnlySnapshotsEveryInterval(t *testing.T) {
+	meta := fsmMeta{}
+
+	for i := 0; i < fsmSnapshotInterval; i++ {
+		plan, err := prepareFSMSave("round-1", meta, []byte("state"))
+		if err != nil {
+			t.Fatalf("call %d: prepareFSMSave: %v", i, err)
+		}
+
+		wantSnapshot := i == 0
+		if plan.TookSnapshot != wantSnapshot {
+			t.Fatalf("call %d: TookSnapshot = %v, want %v", i, plan.TookSnapshot, wantSnapshot)
+		}
+		if len(plan.JournalKey) == 0 || len(plan.JournalValue) == 0 {
+			t.Fatalf("call %d: expected a journal entry to always be written", i)
+		}
+
+		var newMeta fsmMeta
+		if err := gob.NewDecoder(bytes.NewReader(plan.MetaValue)).Decode(&newMeta); err != nil {
+			t.Fatalf("call %d: decode meta: %v", i, err)
+		}
+		meta = newMeta
+	}
+
+	// The fsmSnapshotInterval-th call since the last snapshot rolls a new one.
+	plan, err := prepareFSMSave("round-1", meta, []byte("state"))
+	if err != nil {
+		t.Fatalf("prepareFSMSave: %v", err)
+	}
+	if !plan.TookSnapshot {
+		t.Fatal("expected a snapshot once fsmSnapshotInterval calls have accumulated")
+	}
+	if plan.PruneJournalUpTo != fsmSnapshotInterval+1 {
+		t.Fatalf("expected journal prune cutoff %d, got %d", fsmSnapshotInterval+1, plan.PruneJournalUpTo)
+	}
+}
+
+func TestPrepareFSMSavePrunesOldSnapshotBeyondRetention(t *testing.T) {
+	meta := fsmMeta{LatestVersion: fsmRetainVersions, PendingSinceSnapshot: fsmSnapshotInterval - 1, Seq: 100}
+
+	plan, err := prepareFSMSave("round-1", meta, []byte("state"))
+	if err != nil {
+		t.Fatalf("prepareFSMSave: %v", err)
+	}
+
+	if !plan.TookSnapshot {
+		t.Fatal("expected a snapshot to force pruning of the oldest retained version")
+	}
+
+	wantPrune := fsmSnapshotKey("round-1", 1)
+	if string(plan.PruneSnapshotKey) != string(wantPrune) {
+		t.Fatalf("PruneSnapshotKey = %q, want %q", plan.PruneSnapshotKey, wantPrune)
+	}
+}
+
+func TestPrepareFSMSaveBetweenSnapshotsDoesNotPrune(t *testing.T) {
+	meta := fsmMeta{LatestVersion: 1, PendingSinceSnapshot: 1, Seq: 1}
+
+	plan, err := prepareFSMSave("round-1", meta, []byte("state"))
+	if err != nil {
+		t.Fatalf("prepareFSMSave: %v", err)
+	}
+
+	if plan.TookSnapshot {
+		t.Fatal("expected no snapshot between intervals")
+	}
+	if plan.SnapshotKey != nil || plan.PruneSnapshotKey != nil {
+		t.Fatal("expected no snapshot writes when not taking a snapshot")
+	}
+}
+
+func TestPrepareFSMSaveSameOffsetAcrossMultipleCalls(t *testing.T) {
+	// Several SaveFSM calls can happen while the client is processing a
+	// single queue message, so they all see the same LoadOffset result.
+	// The journal must still key each one distinctly by its own sequence
+	// number rather than colliding on one entry.
+	meta := fsmMeta{}
+
+	var keys [][]byte
+	for i := 0; i < 3; i++ {
+		plan, err := prepareFSMSave("round-1", meta, []byte("state"))
+		if err != nil {
+			t.Fatalf("call %d: prepareFSMSave: %v", i, err)
+		}
+		keys = append(keys, plan.JournalKey)
+
+		var newMeta fsmMeta
+		if err := gob.NewDecoder(bytes.NewReader(plan.MetaValue)).Decode(&newMeta); err != nil {
+			t.Fatalf("call %d: decode meta: %v", i, err)
+		}
+		meta = newMeta
+	}
+
+	seen := map[string]bool{}
+	for i, key := range keys {
+		if seen[string(key)] {
+			t.Fatalf("call %d produced a journal key reused by an earlier call: %q", i, key)
+		}
+		seen[string(key)] = true
+	}
+}
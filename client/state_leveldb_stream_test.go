@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLevelDBStateStreamOperations(t *testing.T) {
+	ctx := context.Background()
+	state := newTestLevelDBState(t)
+
+	want := map[string]bool{"op-1": true, "op-2": true, "op-3": true}
+	for id := range want {
+		if err := state.PutOperation(ctx, &Operation{ID: id}); err != nil {
+			t.Fatalf("PutOperation %s: %v", id, err)
+		}
+	}
+
+	opCh, errCh := state.StreamOperations(ctx)
+
+	got := map[string]bool{}
+	for operation := range opCh {
+		got[operation.ID] = true
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("StreamOperations error: %v", err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("streamed %d operations, want %d", len(got), len(want))
+	}
+	for id := range want {
+		if !got[id] {
+			t.Fatalf("missing streamed operation %s", id)
+		}
+	}
+}
+
+func TestLevelDBStateStreamOperationsCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	state := newTestLevelDBState(t)
+
+	for _, id := range []string{"op-1", "op-2"} {
+		if err := state.PutOperation(context.Background(), &Operation{ID: id}); err != nil {
+			t.Fatalf("PutOperation %s: %v", id, err)
+		}
+	}
+
+	// Deliberately never drain opCh: with nothing to receive the send, the
+	// goroutine's select can only unblock via ctx.Done(), so this is a
+	// deterministic reproduction of what a canceled caller leaves behind if
+	// cancellation isn't wired up.
+	opCh, errCh := state.StreamOperations(ctx)
+	cancel()
+
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("StreamOperations error after cancellation = %v, want context.Canceled", err)
+	}
+	if _, ok := <-opCh; ok {
+		t.Fatal("expected opCh to be closed once StreamOperations observes cancellation")
+	}
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// leakDetectingState wraps memState and reports, via done, whether its
+// StreamOperations goroutine ever returns. A leaked goroutine would block
+// forever trying to send the operation after the one the test corrupts, so
+// done never closing is exactly the bug this test guards against.
+type leakDetectingState struct {
+	*memState
+	done chan struct{}
+}
+
+func (s *leakDetectingState) StreamOperations(ctx context.Context) (<-chan *Operation, <-chan error) {
+	opCh := make(chan *Operation)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(s.done)
+		defer close(opCh)
+		defer close(errCh)
+
+		// Deterministic order so the test can corrupt the second operation
+		// and know the first is what gets decrypted successfully.
+		for _, id := range []string{"op-1", "op-2", "op-3"} {
+			operation, ok := s.memState.operations[id]
+			if !ok {
+				continue
+			}
+			cp := *operation
+			select {
+			case opCh <- &cp:
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return opCh, errCh
+}
+
+func TestEncryptedStateStreamOperationsCancelsUnderlyingStreamOnDecryptError(t *testing.T) {
+	ctx := context.Background()
+	underlying := &leakDetectingState{memState: newMemState(), done: make(chan struct{})}
+
+	enc, err := NewEncryptedState(underlying, []byte("pass"))
+	if err != nil {
+		t.Fatalf("NewEncryptedState: %v", err)
+	}
+
+	for _, id := range []string{"op-1", "op-2", "op-3"} {
+		if err := enc.PutOperation(ctx, &Operation{ID: id, Payload: []byte("payload"), ExtraData: []byte("extra")}); err != nil {
+			t.Fatalf("PutOperation %s: %v", id, err)
+		}
+	}
+	// Corrupt op-2's stored ciphertext so decrypting it fails mid-stream,
+	// the way a bit-flip or a key mismatch would in practice.
+	underlying.operations["op-2"].Payload = []byte("not valid ciphertext")
+
+	opCh, errCh := enc.StreamOperations(ctx)
+
+	var got []*Operation
+	for operation := range opCh {
+		got = append(got, operation)
+	}
+	if len(got) != 1 || got[0].ID != "op-1" {
+		t.Fatalf("expected only op-1 to stream successfully before the decrypt error, got %+v", got)
+	}
+
+	if err := <-errCh; err == nil {
+		t.Fatal("expected a decrypt error on the error channel")
+	}
+
+	select {
+	case <-underlying.done:
+		// The underlying StreamOperations goroutine exited, so its context
+		// was actually canceled instead of leaking it blocked on send.
+	case <-time.After(time.Second):
+		t.Fatal("underlying StreamOperations goroutine leaked: it never observed cancellation")
+	}
+}
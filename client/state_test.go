@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func newTestLevelDBState(t *testing.T) *LevelDBState {
+	t.Helper()
+
+	state, err := NewLevelDBState(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("NewLevelDBState: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := state.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+
+	return state.(*LevelDBState)
+}
+
+func TestLevelDBStatePutGetDeleteOperation(t *testing.T) {
+	ctx := context.Background()
+	state := newTestLevelDBState(t)
+
+	operation := &Operation{ID: "op-1", Payload: []byte("payload")}
+	if err := state.PutOperation(ctx, operation); err != nil {
+		t.Fatalf("PutOperation: %v", err)
+	}
+
+	if err := state.PutOperation(ctx, operation); err == nil {
+		t.Fatal("expected PutOperation to reject a duplicate ID")
+	}
+
+	got, err := state.GetOperationByID(ctx, "op-1")
+	if err != nil {
+		t.Fatalf("GetOperationByID: %v", err)
+	}
+	if got.ID != operation.ID || string(got.Payload) != string(operation.Payload) {
+		t.Fatalf("GetOperationByID = %+v, want %+v", got, operation)
+	}
+
+	operations, err := state.GetOperations(ctx)
+	if err != nil {
+		t.Fatalf("GetOperations: %v", err)
+	}
+	if len(operations) != 1 {
+		t.Fatalf("GetOperations returned %d entries, want 1", len(operations))
+	}
+
+	if err := state.DeleteOperation(ctx, "op-1"); err != nil {
+		t.Fatalf("DeleteOperation: %v", err)
+	}
+	if _, err := state.GetOperationByID(ctx, "op-1"); err == nil {
+		t.Fatal("expected GetOperationByID to fail after deletion")
+	}
+
+	// Deleting an already-absent operation is a no-op, not an error.
+	if err := state.DeleteOperation(ctx, "op-1"); err != nil {
+		t.Fatalf("DeleteOperation of an absent operation: %v", err)
+	}
+}
+
+func TestLevelDBStateReplaceOperationOverwritesExisting(t *testing.T) {
+	ctx := context.Background()
+	state := newTestLevelDBState(t)
+
+	original := &Operation{ID: "op-1", Payload: []byte("original")}
+	if err := state.PutOperation(ctx, original); err != nil {
+		t.Fatalf("PutOperation: %v", err)
+	}
+
+	// Unlike PutOperation, ReplaceOperation must succeed on an existing ID.
+	replaced := &Operation{ID: "op-1", Payload: []byte("replaced")}
+	if err := state.ReplaceOperation(ctx, replaced); err != nil {
+		t.Fatalf("ReplaceOperation: %v", err)
+	}
+
+	got, err := state.GetOperationByID(ctx, "op-1")
+	if err != nil {
+		t.Fatalf("GetOperationByID: %v", err)
+	}
+	if string(got.Payload) != "replaced" {
+		t.Fatalf("GetOperationByID after replace = %+v, want payload %q", got, "replaced")
+	}
+}
+
+func TestLevelDBStateMigratesLegacyOperationsBlob(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+
+	db, err := leveldb.OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatalf("leveldb.OpenFile: %v", err)
+	}
+
+	legacy := map[string]*Operation{
+		"op-1": {ID: "op-1", Payload: []byte("legacy-payload")},
+	}
+	legacyJSON, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if err := db.Put([]byte(operationsKey), legacyJSON, nil); err != nil {
+		t.Fatalf("seed legacy operations blob: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close seeded db: %v", err)
+	}
+
+	state, err := NewLevelDBState(dbPath)
+	if err != nil {
+		t.Fatalf("NewLevelDBState: %v", err)
+	}
+
+	operations, err := state.GetOperations(ctx)
+	if err != nil {
+		t.Fatalf("GetOperations: %v", err)
+	}
+	if len(operations) != 1 || string(operations["op-1"].Payload) != "legacy-payload" {
+		t.Fatalf("GetOperations after migration = %+v, want the legacy op-1 entry", operations)
+	}
+
+	got, err := state.GetOperationByID(ctx, "op-1")
+	if err != nil {
+		t.Fatalf("GetOperationByID after migration: %v", err)
+	}
+	if string(got.Payload) != "legacy-payload" {
+		t.Fatalf("GetOperationByID after migration = %+v", got)
+	}
+
+	if err := state.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A second open must not fail by re-reading an operationsKey that the
+	// first migration already deleted.
+	reopened, err := NewLevelDBState(dbPath)
+	if err != nil {
+		t.Fatalf("NewLevelDBState on an already-migrated db: %v", err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}